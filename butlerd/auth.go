@@ -0,0 +1,221 @@
+package butlerd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Principal identifies who is calling a butlerd method, once an
+// Authenticator has vetted the request. The zero value means "trusted
+// local caller" - what every request gets when Router.Authenticator is
+// nil, preserving butlerd's original "anyone who can open the socket is
+// trusted" behavior.
+type Principal struct {
+	ProfileID int64
+	Scopes    []string
+}
+
+// HasScope reports whether p was granted scope, or the catch-all "admin"
+// scope.
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == "admin" {
+			return true
+		}
+	}
+	return false
+}
+
+// Policy declares what a Principal needs to call a method registered
+// with Router.RegisterWithPolicy.
+type Policy struct {
+	// Scopes lists the scopes a Principal must hold at least one of (or
+	// "admin") to invoke the method. A nil/empty slice means any
+	// authenticated Principal may call it.
+	Scopes []string
+}
+
+func (p Policy) allows(principal Principal) bool {
+	if len(p.Scopes) == 0 {
+		return true
+	}
+	for _, scope := range p.Scopes {
+		if principal.HasScope(scope) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator vets an incoming request before Router looks up its
+// handler. It runs for every request when set as Router.Authenticator,
+// including for methods with no Policy attached - those just don't
+// require any particular scope once authenticated.
+type Authenticator interface {
+	Authenticate(ctx context.Context, inv invocation) (Principal, error)
+}
+
+// SharedSecretAuthenticator is the simplest Authenticator: a fixed
+// secret butlerd was started with, handed to it once per connection via
+// a `Meta.Authenticate` call. Meant for local IPC where the secret can
+// be passed to the client out of band (e.g. over stdin), not for
+// exposing butlerd on a shared network.
+type SharedSecretAuthenticator struct {
+	Secret string
+
+	mu            sync.Mutex
+	authenticated map[interface{}]bool
+}
+
+type sharedSecretParams struct {
+	Secret string `json:"secret"`
+}
+
+// MetaAuthenticateResult is the trivial success payload for a completed
+// `Meta.Authenticate` handshake.
+type MetaAuthenticateResult struct {
+	OK bool `json:"ok"`
+}
+
+// handleMetaAuthenticate is the handler NewRouter registers for
+// `Meta.Authenticate`. The handshake itself does nothing, since
+// Authenticate below (which runs before any handler, see Router.invoke)
+// already checked the secret and marked the connection authenticated by
+// the time this runs - it only exists so the handshake call gets a
+// reply instead of falling through to "method not found".
+func handleMetaAuthenticate(rc *RequestContext) (interface{}, error) {
+	return &MetaAuthenticateResult{OK: true}, nil
+}
+
+// Authenticate keys authenticated state off inv.ConnKey rather than
+// inv.Conn: Conn is a fresh wrapper value built by Dispatch/DispatchBatch
+// on every single call, so it can never match itself across requests,
+// but ConnKey is the stable underlying connection (see invocation in
+// transport.go) every request on that connection shares.
+func (a *SharedSecretAuthenticator) Authenticate(ctx context.Context, inv invocation) (Principal, error) {
+	if inv.Method == "Meta.Authenticate" {
+		var params sharedSecretParams
+		if inv.Params != nil {
+			if err := json.Unmarshal(*inv.Params, &params); err != nil {
+				return Principal{}, errors.WithStack(err)
+			}
+		}
+		if params.Secret != a.Secret {
+			return Principal{}, errors.New("invalid secret")
+		}
+		a.markAuthenticated(inv.ConnKey)
+		return Principal{Scopes: []string{"admin"}}, nil
+	}
+
+	if !a.isAuthenticated(inv.ConnKey) {
+		return Principal{}, errors.New("connection has not completed the Meta.Authenticate handshake")
+	}
+	return Principal{Scopes: []string{"admin"}}, nil
+}
+
+func (a *SharedSecretAuthenticator) markAuthenticated(connKey interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.authenticated == nil {
+		a.authenticated = make(map[interface{}]bool)
+	}
+	a.authenticated[connKey] = true
+}
+
+func (a *SharedSecretAuthenticator) isAuthenticated(connKey interface{}) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.authenticated[connKey]
+}
+
+// Token is a narrow, revocable credential scoped to a single Profile,
+// minted by TokenAuthenticator.Mint so a browser extension or
+// third-party tool can hold it instead of the raw itch.io API key
+// stored in models.Profile.APIKey.
+type Token struct {
+	Value     string
+	ProfileID int64
+	Scopes    []string
+}
+
+// TokenAuthenticator authenticates requests carrying a `token` params
+// field against an in-memory set of minted Tokens. Unlike
+// SharedSecretAuthenticator, it identifies which Profile is calling, so
+// handlers can scope database access to that profile.
+type TokenAuthenticator struct {
+	mu     sync.Mutex
+	tokens map[string]Token
+}
+
+func NewTokenAuthenticator() *TokenAuthenticator {
+	return &TokenAuthenticator{
+		tokens: make(map[string]Token),
+	}
+}
+
+// Mint creates a new Token scoped to profileID and scopes, stores it,
+// and returns it for the caller to hand out. The caller is responsible
+// for remembering Token.Value if it wants to Revoke it later.
+func (a *TokenAuthenticator) Mint(profileID int64, scopes []string) (Token, error) {
+	value, err := randomTokenValue()
+	if err != nil {
+		return Token{}, err
+	}
+
+	token := Token{
+		Value:     value,
+		ProfileID: profileID,
+		Scopes:    scopes,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.tokens[token.Value] = token
+	return token, nil
+}
+
+// Revoke removes a previously minted token; requests bearing it are
+// rejected from then on.
+func (a *TokenAuthenticator) Revoke(value string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.tokens, value)
+}
+
+type tokenAuthParams struct {
+	Token string `json:"token"`
+}
+
+func (a *TokenAuthenticator) Authenticate(ctx context.Context, inv invocation) (Principal, error) {
+	var params tokenAuthParams
+	if inv.Params != nil {
+		if err := json.Unmarshal(*inv.Params, &params); err != nil {
+			return Principal{}, errors.WithStack(err)
+		}
+	}
+	if params.Token == "" {
+		return Principal{}, errors.New("missing token")
+	}
+
+	a.mu.Lock()
+	token, ok := a.tokens[params.Token]
+	a.mu.Unlock()
+	if !ok {
+		return Principal{}, errors.New("unknown or revoked token")
+	}
+
+	return Principal{ProfileID: token.ProfileID, Scopes: token.Scopes}, nil
+}
+
+func randomTokenValue() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", errors.WithStack(err)
+	}
+	return hex.EncodeToString(buf), nil
+}
@@ -0,0 +1,97 @@
+package butlerd
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	cases := []struct {
+		name   string
+		policy Policy
+		p      Principal
+		want   bool
+	}{
+		{"no scopes required", Policy{}, Principal{}, true},
+		{"missing scope", Policy{Scopes: []string{"read"}}, Principal{}, false},
+		{"matching scope", Policy{Scopes: []string{"read"}}, Principal{Scopes: []string{"read"}}, true},
+		{"admin bypasses", Policy{Scopes: []string{"read"}}, Principal{Scopes: []string{"admin"}}, true},
+		{"unrelated scope", Policy{Scopes: []string{"read"}}, Principal{Scopes: []string{"write"}}, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.policy.allows(tc.p); got != tc.want {
+				t.Fatalf("Policy%v.allows(%v) = %v, want %v", tc.policy, tc.p, got, tc.want)
+			}
+		})
+	}
+}
+
+// TestSharedSecretAuthenticator exercises the handshake gate end to end:
+// a connection can't call anything else until it presents the right
+// secret via Meta.Authenticate, and that only has to happen once per
+// ConnKey.
+func TestSharedSecretAuthenticator(t *testing.T) {
+	a := &SharedSecretAuthenticator{Secret: "hunter2"}
+	ctx := context.Background()
+	connKey := new(int) // any comparable value stands in for a real conn
+
+	if _, err := a.Authenticate(ctx, invocation{Method: "Games.Get", ConnKey: connKey}); err == nil {
+		t.Fatal("expected Authenticate to reject a call before the handshake")
+	}
+
+	badSecret := rawParams(t, map[string]string{"secret": "wrong"})
+	if _, err := a.Authenticate(ctx, invocation{Method: "Meta.Authenticate", Params: badSecret, ConnKey: connKey}); err == nil {
+		t.Fatal("expected Authenticate to reject the wrong secret")
+	}
+
+	goodSecret := rawParams(t, map[string]string{"secret": "hunter2"})
+	principal, err := a.Authenticate(ctx, invocation{Method: "Meta.Authenticate", Params: goodSecret, ConnKey: connKey})
+	if err != nil {
+		t.Fatalf("Authenticate with correct secret: %v", err)
+	}
+	if !principal.HasScope("admin") {
+		t.Fatalf("principal %v missing admin scope after handshake", principal)
+	}
+
+	if _, err := a.Authenticate(ctx, invocation{Method: "Games.Get", ConnKey: connKey}); err != nil {
+		t.Fatalf("expected calls to succeed on the now-authenticated connection, got %v", err)
+	}
+
+	otherConnKey := new(int)
+	if _, err := a.Authenticate(ctx, invocation{Method: "Games.Get", ConnKey: otherConnKey}); err == nil {
+		t.Fatal("expected a different connection to still need its own handshake")
+	}
+}
+
+// TestTokenAuthenticator covers minting, successful auth, and rejecting
+// a revoked or unknown token.
+func TestTokenAuthenticator(t *testing.T) {
+	a := NewTokenAuthenticator()
+	ctx := context.Background()
+
+	token, err := a.Mint(42, []string{"read"})
+	if err != nil {
+		t.Fatalf("Mint: %v", err)
+	}
+
+	params := rawParams(t, map[string]string{"token": token.Value})
+	principal, err := a.Authenticate(ctx, invocation{Method: "Games.Get", Params: params})
+	if err != nil {
+		t.Fatalf("Authenticate with minted token: %v", err)
+	}
+	if principal.ProfileID != 42 {
+		t.Fatalf("principal.ProfileID = %d, want 42", principal.ProfileID)
+	}
+
+	a.Revoke(token.Value)
+	if _, err := a.Authenticate(ctx, invocation{Method: "Games.Get", Params: params}); err == nil {
+		t.Fatal("expected Authenticate to reject a revoked token")
+	}
+
+	unknown := rawParams(t, map[string]string{"token": "does-not-exist"})
+	if _, err := a.Authenticate(ctx, invocation{Method: "Games.Get", Params: unknown}); err == nil {
+		t.Fatal("expected Authenticate to reject an unknown token")
+	}
+}
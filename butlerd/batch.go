@@ -0,0 +1,125 @@
+package butlerd
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// DispatchBatch handles a JSON-RPC2 batch: a top-level JSON array of
+// requests/notifications sent as one message so a client doesn't pay a
+// round trip per call (e.g. kicking off several independent fetches at
+// once). Each element is dispatched on its own goroutine - bounded by
+// Router.MaxConcurrentRequests, if set - through the same invoke path
+// Dispatch uses, so the response or error for a given element carries
+// that element's own request ID. Notifications an element sends while it
+// runs (Progress and the like) go out as ordinary JSON-RPC2
+// notifications, which carry no request ID. Responses are reassembled in
+// the original array order; notifications don't get a slot in the result.
+func (r *Router) DispatchBatch(ctx context.Context, origConn *jsonrpc2.Conn, reqs []*jsonrpc2.Request) []*jsonrpc2.Response {
+	responses := make([]*jsonrpc2.Response, len(reqs))
+
+	var sem chan struct{}
+	if r.MaxConcurrentRequests > 0 {
+		sem = make(chan struct{}, r.MaxConcurrentRequests)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for i, req := range reqs {
+		go func(i int, req *jsonrpc2.Request) {
+			defer wg.Done()
+
+			if sem != nil {
+				sem <- struct{}{}
+				defer func() { <-sem }()
+			}
+
+			conn := &JsonRPC2Conn{origConn}
+			res, err := r.invoke(ctx, invocation{
+				ID:      req.ID.String(),
+				Method:  req.Method,
+				Notif:   req.Notif,
+				Params:  req.Params,
+				Conn:    conn,
+				ConnKey: origConn,
+			})
+			responses[i] = r.buildResponse(req, res, err)
+		}(i, req)
+	}
+	wg.Wait()
+
+	out := make([]*jsonrpc2.Response, 0, len(responses))
+	for _, res := range responses {
+		if res != nil {
+			out = append(out, res)
+		}
+	}
+	return out
+}
+
+// buildResponse turns a handler's result into the jsonrpc2.Response a
+// batch reassembles into its reply array. Notifications get no slot -
+// they return nil, same as they get no top-level reply outside a batch.
+func (r *Router) buildResponse(req *jsonrpc2.Request, res interface{}, err error) *jsonrpc2.Response {
+	if req.Notif {
+		return nil
+	}
+
+	if err != nil {
+		return &jsonrpc2.Response{ID: req.ID, Error: r.toJSONRPCError(err)}
+	}
+
+	raw, marshalErr := json.Marshal(res)
+	if marshalErr != nil {
+		return &jsonrpc2.Response{ID: req.ID, Error: r.toJSONRPCError(marshalErr)}
+	}
+
+	rawMessage := json.RawMessage(raw)
+	return &jsonrpc2.Response{ID: req.ID, Result: &rawMessage}
+}
+
+// CancelBatch cancels every id in ids still registered in r.CancelFuncs,
+// returning how many it actually cancelled. It's the fan-out a
+// Meta.CancelBatch handler delegates to, given the request IDs of the
+// batch elements a client wants to abort while they are still running.
+func (r *Router) CancelBatch(ids []string) int {
+	cancelled := 0
+	for _, id := range ids {
+		if r.CancelFuncs.Call(id) {
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// MetaCancelBatchParams are the params for the `Meta.CancelBatch`
+// request, registered by NewRouter - the wire-callable counterpart to
+// CancelBatch. Only elements still in flight can be cancelled: once a
+// batch has replied, every element has removed its CancelFunc. Over
+// JSON-RPC2, the connection a batch arrived on reads no further messages
+// until that batch's reply is written (see batchAwareCodec), so the
+// cancel call has to come in on another connection.
+type MetaCancelBatchParams struct {
+	IDs []string `json:"ids"`
+}
+
+// MetaCancelBatchResult reports how many of the requested IDs were
+// still in flight and got cancelled.
+type MetaCancelBatchResult struct {
+	Cancelled int `json:"cancelled"`
+}
+
+func (r *Router) handleMetaCancelBatch(rc *RequestContext) (interface{}, error) {
+	var params MetaCancelBatchParams
+	if rc.Params != nil {
+		if err := json.Unmarshal(*rc.Params, &params); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+
+	return &MetaCancelBatchResult{Cancelled: r.CancelBatch(params.IDs)}, nil
+}
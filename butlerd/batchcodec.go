@@ -0,0 +1,156 @@
+package butlerd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// batchHandledNotification is what ReadObject decodes an already-handled
+// batch into: a notification with a reserved, never-registered method,
+// so jsonrpc2's own read loop treats the cycle as a harmless no-op
+// instead of trying to reinterpret the (already-consumed) batch bytes as
+// a single Request.
+const batchHandledNotification = `{"jsonrpc":"2.0","method":"$/batchHandled"}`
+
+// batchAwareCodec sits in front of jsonrpc2's usual Content-Length
+// framing and recognizes a top-level JSON array - the wire shape of a
+// JSON-RPC2 batch - before jsonrpc2's own per-message dispatch ever sees
+// it, since that only understands a single Request or Response object.
+// A batch is decoded and run through Router.DispatchBatch right here,
+// with the resulting []Response written back in the same framing a
+// single reply (jsonrpc2.Conn.Reply, via Dispatch) uses.
+//
+// Known limitation: the batch reply below is written directly to the
+// connection, bypassing the write lock jsonrpc2.Conn holds around its
+// own Reply/Notify calls. A Notify fired by some other in-flight request
+// on the same connection while a batch reply is being written could in
+// principle interleave with it - accepted for now since butlerd clients
+// don't mix batches with concurrent traffic on one connection, but worth
+// revisiting if that changes.
+type batchAwareCodec struct {
+	router *Router
+	ctx    context.Context
+	writer io.Writer
+
+	mu   sync.Mutex
+	conn *jsonrpc2.Conn // backfilled once NewConn returns, see setConn
+}
+
+// setConn backfills the *jsonrpc2.Conn DispatchBatch needs for
+// mid-batch Notify calls (see RequestContext.Notify) - it doesn't exist
+// yet when the codec has to be constructed, since jsonrpc2.NewConn is
+// what creates it, and NewConn itself needs the codec first.
+func (c *batchAwareCodec) setConn(conn *jsonrpc2.Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn = conn
+}
+
+func (c *batchAwareCodec) ReadObject(stream *bufio.Reader, v interface{}) error {
+	body, err := readContentLengthFramedBody(stream)
+	if err != nil {
+		return err
+	}
+
+	if !isJSONArray(body) {
+		return json.Unmarshal(body, v)
+	}
+
+	if err := c.dispatchBatch(body); err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(batchHandledNotification), v)
+}
+
+func (c *batchAwareCodec) WriteObject(stream io.Writer, obj interface{}) error {
+	return jsonrpc2.VSCodeObjectCodec{}.WriteObject(stream, obj)
+}
+
+// dispatchBatch parses body as a JSON-RPC2 batch, runs it through
+// Router.DispatchBatch, and writes the reassembled []Response straight
+// back to the connection - DispatchBatch itself only returns the
+// responses, since (unlike Dispatch) it has no single request/origConn
+// pair to reply through.
+func (c *batchAwareCodec) dispatchBatch(body []byte) error {
+	var reqs []*jsonrpc2.Request
+	if err := json.Unmarshal(body, &reqs); err != nil {
+		return errors.WithStack(err)
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	responses := c.router.DispatchBatch(c.ctx, conn, reqs)
+
+	data, err := json.Marshal(responses)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	if _, err := fmt.Fprintf(c.writer, "Content-Length: %d\r\n\r\n", len(data)); err != nil {
+		return errors.WithStack(err)
+	}
+	_, err = c.writer.Write(data)
+	return errors.WithStack(err)
+}
+
+// readContentLengthFramedBody reads one LSP-style Content-Length framed
+// message body off stream - the same framing jsonrpc2.VSCodeObjectCodec
+// uses - without assuming anything about its JSON shape, so the caller
+// can inspect it before deciding whether it's a single message or a
+// batch array.
+func readContentLengthFramedBody(stream *bufio.Reader) ([]byte, error) {
+	contentLength := int64(-1)
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return nil, errors.WithStack(err)
+			}
+			contentLength = n
+		}
+	}
+	if contentLength < 0 {
+		return nil, errors.New("jsonrpc2: message has no Content-Length header")
+	}
+
+	body := make([]byte, contentLength)
+	if _, err := io.ReadFull(stream, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// isJSONArray reports whether body's first non-whitespace byte opens a
+// JSON array - the wire shape DispatchBatch expects, as opposed to the
+// JSON object every single Request/Response is.
+func isJSONArray(body []byte) bool {
+	for _, b := range body {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		default:
+			return b == '['
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+// Hand-written stand-in for protoc-gen-go output from butlerd/butlerd.proto,
+// maintained by hand until protoc is wired into the build: keep it
+// in sync with butlerd.proto by hand, regenerate for real once the
+// toolchain is available. These types deliberately don't implement
+// proto.Message - the grpc server registers a JSON codec in its place
+// (see butlerdJSONCodec in ../grpc.go) instead of pretending plain
+// structs are protoc output.
+
+package butlerdpb
+
+type CallRequest struct {
+	Id         string
+	Method     string
+	ParamsJson string
+}
+
+type Event struct {
+	RequestId string
+
+	// Payload is one of Event_Notification, Event_ReplyJson or Event_Error.
+	Payload isEvent_Payload
+}
+
+type isEvent_Payload interface {
+	isEvent_Payload()
+}
+
+type Event_Notification struct {
+	Notification *Notification
+}
+
+type Event_ReplyJson struct {
+	ReplyJson string
+}
+
+type Event_Error struct {
+	Error *RpcError
+}
+
+func (*Event_Notification) isEvent_Payload() {}
+func (*Event_ReplyJson) isEvent_Payload()    {}
+func (*Event_Error) isEvent_Payload()        {}
+
+type Notification struct {
+	Method     string
+	ParamsJson string
+}
+
+type RpcError struct {
+	Code    int64
+	Message string
+}
@@ -0,0 +1,72 @@
+// Hand-written stand-in for protoc-gen-go-grpc output from
+// butlerd/butlerd.proto, maintained by hand until protoc is wired into
+// the build: keep it
+// in sync with butlerd.proto by hand, regenerate for real once the
+// toolchain is available.
+
+package butlerdpb
+
+import (
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ButlerServer is the server API for the Butler service.
+type ButlerServer interface {
+	Call(Butler_CallServer) error
+}
+
+// UnimplementedButlerServer can be embedded to have forward compatible
+// implementations.
+type UnimplementedButlerServer struct{}
+
+func (UnimplementedButlerServer) Call(Butler_CallServer) error {
+	return status.Errorf(codes.Unimplemented, "method Call not implemented")
+}
+
+// Butler_CallServer is the server-side stream for the bidi-streamed Call
+// RPC.
+type Butler_CallServer interface {
+	Send(*Event) error
+	Recv() (*CallRequest, error)
+	grpc.ServerStream
+}
+
+func RegisterButlerServer(s *grpc.Server, srv ButlerServer) {
+	s.RegisterService(&_Butler_serviceDesc, srv)
+}
+
+var _Butler_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "butlerd.Butler",
+	HandlerType: (*ButlerServer)(nil),
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Call",
+			Handler:       _Butler_Call_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "butlerd/butlerd.proto",
+}
+
+func _Butler_Call_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(ButlerServer).Call(&butlerCallServer{stream})
+}
+
+type butlerCallServer struct {
+	grpc.ServerStream
+}
+
+func (x *butlerCallServer) Send(e *Event) error {
+	return x.ServerStream.SendMsg(e)
+}
+
+func (x *butlerCallServer) Recv() (*CallRequest, error) {
+	m := new(CallRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
@@ -0,0 +1,41 @@
+package butlerd
+
+// Code is a well-known butlerd error, translated to (and from) the
+// numeric `code` field of a JSON-RPC2 error reply so callers can switch
+// on a failure class instead of parsing message text.
+type Code int64
+
+const (
+	CodeNetworkDisconnected Code = 1001
+	CodeOperationCancelled  Code = 1002
+
+	// CodeOperationTimedOut is returned when a request's deadline (set
+	// via the `deadline`/`timeoutMs` params fields, see
+	// withRequestDeadline) elapses before its handler returns.
+	CodeOperationTimedOut Code = 1003
+
+	// CodeUnauthenticated is returned when Router.Authenticator rejects
+	// a request outright (missing/invalid credentials).
+	CodeUnauthenticated Code = 1004
+	// CodePermissionDenied is returned when a request authenticates
+	// fine but its Principal lacks a scope required by the method's
+	// Policy.
+	CodePermissionDenied Code = 1005
+)
+
+func (c Code) Error() string {
+	switch c {
+	case CodeNetworkDisconnected:
+		return "Network disconnected"
+	case CodeOperationCancelled:
+		return "Operation cancelled"
+	case CodeOperationTimedOut:
+		return "Operation timed out"
+	case CodeUnauthenticated:
+		return "Unauthenticated"
+	case CodePermissionDenied:
+		return "Permission denied"
+	default:
+		return "Unknown error"
+	}
+}
@@ -0,0 +1,66 @@
+package butlerd
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics holds the Prometheus collectors MetricsMiddleware records
+// into: a counter of calls per method/outcome, a histogram of call
+// durations per method, and a gauge of in-flight calls per method.
+type Metrics struct {
+	Calls    *prometheus.CounterVec
+	Duration *prometheus.HistogramVec
+	InFlight *prometheus.GaugeVec
+}
+
+// NewMetrics builds a Metrics with the standard butlerd_rpc_* collectors.
+// Register them with a prometheus.Registerer, then pass m.Middleware()
+// to Router.Use.
+func NewMetrics() *Metrics {
+	return &Metrics{
+		Calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "butlerd_rpc_calls_total",
+			Help: "Total butlerd RPC calls, by method and outcome.",
+		}, []string{"method", "outcome"}),
+		Duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name: "butlerd_rpc_duration_seconds",
+			Help: "butlerd RPC call duration in seconds, by method.",
+		}, []string{"method"}),
+		InFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "butlerd_rpc_in_flight",
+			Help: "butlerd RPC calls currently in flight, by method.",
+		}, []string{"method"}),
+	}
+}
+
+// Collectors returns m's collectors, for registering with a
+// prometheus.Registerer in one call.
+func (m *Metrics) Collectors() []prometheus.Collector {
+	return []prometheus.Collector{m.Calls, m.Duration, m.InFlight}
+}
+
+// Middleware records m.Calls, m.Duration and m.InFlight around every
+// call it wraps.
+func (m *Metrics) Middleware() Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(rc *RequestContext) (interface{}, error) {
+			gauge := m.InFlight.WithLabelValues(rc.Method)
+			gauge.Inc()
+			defer gauge.Dec()
+
+			start := time.Now()
+			res, err := next(rc)
+			m.Duration.WithLabelValues(rc.Method).Observe(time.Since(start).Seconds())
+
+			outcome := "ok"
+			if err != nil {
+				outcome = "error"
+			}
+			m.Calls.WithLabelValues(rc.Method, outcome).Inc()
+
+			return res, err
+		}
+	}
+}
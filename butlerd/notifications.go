@@ -0,0 +1,10 @@
+package butlerd
+
+// TimeoutNotification is fired when a request's deadline (see
+// withRequestDeadline) elapses before its handler returns, mirroring
+// ProgressNotification: it lets the frontend render "still waiting" /
+// "gave up" state instead of guessing why a call went quiet.
+type TimeoutNotification struct {
+	ElapsedSeconds   float64 `json:"elapsedSeconds"`
+	RemainingSeconds float64 `json:"remainingSeconds"`
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 
 	"github.com/itchio/wharf/werrors"
 
@@ -26,24 +28,48 @@ type GetClientFunc func(key string) *itchio.Client
 type Router struct {
 	Handlers             map[string]RequestHandler
 	NotificationHandlers map[string]NotificationHandler
+	Policies             map[string]Policy
 	CancelFuncs          *CancelFuncs
 	dbPool               *sqlite.Pool
 	getClient            GetClientFunc
+	middlewares          []Middleware
+
+	// Authenticator, if set, runs before handler lookup for every
+	// request and notification. Leave nil to keep butlerd's original
+	// "anyone who can open the socket is trusted" behavior.
+	Authenticator Authenticator
+
+	// MaxConcurrentRequests bounds how many elements of a JSON-RPC2
+	// batch (see DispatchBatch) run at once. Zero means unbounded.
+	MaxConcurrentRequests int
 
 	ButlerVersion       string
 	ButlerVersionString string
 }
 
 func NewRouter(dbPool *sqlite.Pool, getClient GetClientFunc) *Router {
-	return &Router{
+	r := &Router{
 		Handlers:             make(map[string]RequestHandler),
 		NotificationHandlers: make(map[string]NotificationHandler),
+		Policies:             make(map[string]Policy),
 		CancelFuncs: &CancelFuncs{
 			Funcs: make(map[string]context.CancelFunc),
 		},
 		dbPool:    dbPool,
 		getClient: getClient,
 	}
+
+	// Registered outermost so it still catches a panic raised by any
+	// later-registered middleware, not just the handler - matching the
+	// old inline recover in Dispatch it replaces (see middleware.go). A
+	// caller who wants different panic semantics is free to compose
+	// their own via Use instead of relying on this default.
+	r.Use(PanicRecoveryMiddleware())
+
+	r.Register("Meta.Authenticate", handleMetaAuthenticate)
+	r.Register("Meta.CancelBatch", r.handleMetaCancelBatch)
+
+	return r
 }
 
 func (r *Router) Register(method string, rh RequestHandler) {
@@ -53,6 +79,16 @@ func (r *Router) Register(method string, rh RequestHandler) {
 	r.Handlers[method] = rh
 }
 
+// RegisterWithPolicy is like Register, but additionally requires
+// whoever calls method to authenticate as a Principal satisfying
+// policy. It only has teeth once Router.Authenticator is set - with no
+// Authenticator, invoke skips the Policy check entirely and every caller
+// gets the zero Principal.
+func (r *Router) RegisterWithPolicy(method string, rh RequestHandler, policy Policy) {
+	r.Register(method, rh)
+	r.Policies[method] = policy
+}
+
 func (r *Router) RegisterNotification(method string, nh NotificationHandler) {
 	if _, ok := r.NotificationHandlers[method]; ok {
 		panic(fmt.Sprintf("Can't register handler twice for %s", method))
@@ -60,101 +96,45 @@ func (r *Router) RegisterNotification(method string, nh NotificationHandler) {
 	r.NotificationHandlers[method] = nh
 }
 
+// Dispatch handles a single incoming request or notification from the
+// jsonrpc2 transport. It's a thin adapter over invoke: it wraps origConn
+// in a Conn, runs the handler, and translates the result back into a
+// jsonrpc2 reply. The gRPC transport (see grpc.go) has its own thin
+// adapter that calls the same invoke.
 func (r *Router) Dispatch(ctx context.Context, origConn *jsonrpc2.Conn, req *jsonrpc2.Request) {
-	method := req.Method
-	var res interface{}
-
 	conn := &JsonRPC2Conn{origConn}
-	consumer, cErr := NewStateConsumer(&NewStateConsumerParams{
-		Ctx:  ctx,
-		Conn: conn,
-	})
-	if cErr != nil {
-		return
-	}
 
-	err := func() (err error) {
-		defer func() {
-			if r := recover(); r != nil {
-				if rErr, ok := r.(error); ok {
-					err = errors.WithStack(rErr)
-				} else {
-					err = errors.Errorf("panic: %v", r)
-				}
-			}
-		}()
-
-		rc := &RequestContext{
-			Ctx:         ctx,
-			Consumer:    consumer,
-			Params:      req.Params,
-			Conn:        conn,
-			CancelFuncs: r.CancelFuncs,
-			DBPool:      r.dbPool,
-			Client:      r.getClient,
-
-			ButlerVersion:       r.ButlerVersion,
-			ButlerVersionString: r.ButlerVersionString,
-		}
-
-		if req.Notif {
-			if nh, ok := r.NotificationHandlers[req.Method]; ok {
-				nh(rc)
-			}
-		} else {
-			if h, ok := r.Handlers[method]; ok {
-				rc.Consumer.OnProgress = func(alpha float64) {
-					if rc.tracker == nil {
-						// skip
-						return
-					}
-
-					rc.tracker.SetProgress(alpha)
-					notif := &ProgressNotification{
-						Progress: alpha,
-						ETA:      rc.tracker.ETA().Seconds(),
-						BPS:      rc.tracker.BPS(),
-					}
-					// cannot use autogenerated wrappers to avoid import cycles
-					rc.Notify("Progress", notif)
-				}
-				rc.Consumer.OnProgressLabel = func(label string) {
-					// muffin
-				}
-				rc.Consumer.OnPauseProgress = func() {
-					if rc.tracker != nil {
-						rc.tracker.Pause()
-					}
-				}
-				rc.Consumer.OnResumeProgress = func() {
-					if rc.tracker != nil {
-						rc.tracker.Resume()
-					}
-				}
-
-				res, err = h(rc)
-			} else {
-				err = &RpcError{
-					Code:    jsonrpc2.CodeMethodNotFound,
-					Message: fmt.Sprintf("Method '%s' not found", req.Method),
-				}
-			}
-		}
-		return
-	}()
+	res, err := r.invoke(ctx, invocation{
+		ID:      req.ID.String(),
+		Method:  req.Method,
+		Notif:   req.Notif,
+		Params:  req.Params,
+		Conn:    conn,
+		ConnKey: origConn,
+	})
 
 	if req.Notif {
 		return
 	}
 
 	if err == nil {
-		err = origConn.Reply(ctx, req.ID, res)
-		if err != nil {
-			consumer.Errorf("Error while replying: %s", err.Error())
+		if replyErr := origConn.Reply(ctx, req.ID, res); replyErr != nil {
+			if consumer, cErr := NewStateConsumer(&NewStateConsumerParams{Ctx: ctx, Conn: conn}); cErr == nil {
+				consumer.Errorf("Error while replying: %s", replyErr.Error())
+			}
 		}
 		return
 	}
 
+	origConn.ReplyWithError(ctx, req.ID, r.toJSONRPCError(err))
+}
+
+// toJSONRPCError maps a handler error to the jsonrpc2.Error a caller
+// gets back, whether it's a well-known *RpcError from AsButlerdError, a
+// network hiccup, a cancelled or timed-out context, or anything else.
+// Both Dispatch and DispatchBatch (see batch.go) go through this so
+// single and batched calls fail the same way.
+func (r *Router) toJSONRPCError(err error) *jsonrpc2.Error {
 	var code int64
 	var message string
 	var data map[string]interface{}
@@ -163,37 +143,37 @@ func (r *Router) Dispatch(ctx context.Context, origConn *jsonrpc2.Conn, req *jso
 		code = ee.RpcErrorCode()
 		message = ee.RpcErrorMessage()
 		data = ee.RpcErrorData()
+	} else if neterr.IsNetworkError(err) {
+		code = int64(CodeNetworkDisconnected)
+		message = CodeNetworkDisconnected.Error()
+	} else if errors.Cause(err) == werrors.ErrCancelled {
+		code = int64(CodeOperationCancelled)
+		message = CodeOperationCancelled.Error()
+	} else if errors.Cause(err) == context.DeadlineExceeded {
+		code = int64(CodeOperationTimedOut)
+		message = CodeOperationTimedOut.Error()
 	} else {
-		if neterr.IsNetworkError(err) {
-			code = int64(CodeNetworkDisconnected)
-			message = CodeNetworkDisconnected.Error()
-		} else if errors.Cause(err) == werrors.ErrCancelled {
-			code = int64(CodeOperationCancelled)
-			message = CodeOperationCancelled.Error()
-		} else {
-			code = jsonrpc2.CodeInternalError
-			message = err.Error()
-		}
+		code = jsonrpc2.CodeInternalError
+		message = err.Error()
 	}
 
-	var rawData *json.RawMessage
 	if data == nil {
 		data = make(map[string]interface{})
 	}
 	data["stack"] = fmt.Sprintf("%+v", err)
 	data["butlerVersion"] = r.ButlerVersionString
 
-	marshalledData, marshalErr := json.Marshal(data)
-	if marshalErr == nil {
+	var rawData *json.RawMessage
+	if marshalledData, marshalErr := json.Marshal(data); marshalErr == nil {
 		rawMessage := json.RawMessage(marshalledData)
 		rawData = &rawMessage
 	}
 
-	origConn.ReplyWithError(ctx, req.ID, &jsonrpc2.Error{
+	return &jsonrpc2.Error{
 		Code:    code,
 		Message: message,
 		Data:    rawData,
-	})
+	}
 }
 
 type RequestContext struct {
@@ -205,6 +185,16 @@ type RequestContext struct {
 	DBPool      *sqlite.Pool
 	Client      GetClientFunc
 
+	// Method and ID identify the call for middlewares (see middleware.go)
+	// that need to tag spans, metrics or logs - handlers themselves
+	// generally don't need them, since they're registered one-per-method.
+	Method string
+	ID     string
+
+	// Principal is who Router.Authenticator decided is calling, or the
+	// zero Principal if no Authenticator is configured.
+	Principal Principal
+
 	ButlerVersion       string
 	ButlerVersionString string
 
@@ -309,24 +299,71 @@ func (rc *RequestContext) WithConnBool(f func(conn *sqlite.Conn) bool) bool {
 	return f(conn)
 }
 
+// CancelFuncs tracks the CancelFunc for every in-flight request, keyed
+// by request ID, so Meta.Cancel (and Meta.CancelBatch, see batch.go) can
+// abort one by ID. Funcs is mutated from whichever goroutine Dispatch
+// happens to run a given request on, so every access goes through mu -
+// don't range over or index Funcs directly.
 type CancelFuncs struct {
+	mu    sync.Mutex
 	Funcs map[string]context.CancelFunc
 }
 
 func (cf *CancelFuncs) Add(id string, f context.CancelFunc) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
 	cf.Funcs[id] = f
 }
 
 func (cf *CancelFuncs) Remove(id string) {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
 	delete(cf.Funcs, id)
 }
 
 func (cf *CancelFuncs) Call(id string) bool {
-	if f, ok := cf.Funcs[id]; ok {
-		f()
+	cf.mu.Lock()
+	f, ok := cf.Funcs[id]
+	if ok {
 		delete(cf.Funcs, id)
-		return true
 	}
+	cf.mu.Unlock()
 
-	return false
+	if ok {
+		f()
+	}
+	return ok
+}
+
+// Snapshot returns the request IDs currently registered, for shutdown
+// code that wants to see what's still in flight without racing Add/Remove.
+func (cf *CancelFuncs) Snapshot() []string {
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+
+	ids := make([]string, 0, len(cf.Funcs))
+	for id := range cf.Funcs {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// CancelAll calls and removes every registered CancelFunc whose id has
+// the given prefix, returning how many it cancelled. Pass "" to cancel
+// everything, e.g. on shutdown.
+func (cf *CancelFuncs) CancelAll(prefix string) int {
+	cf.mu.Lock()
+	var toCancel []context.CancelFunc
+	for id, f := range cf.Funcs {
+		if strings.HasPrefix(id, prefix) {
+			toCancel = append(toCancel, f)
+			delete(cf.Funcs, id)
+		}
+	}
+	cf.mu.Unlock()
+
+	for _, f := range toCancel {
+		f()
+	}
+	return len(toCancel)
 }
@@ -0,0 +1,78 @@
+package butlerd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestCancelFuncsConcurrent exercises Add/Remove/Call/Snapshot/CancelAll
+// from many goroutines at once, the way Dispatch and DispatchBatch (see
+// batch.go) actually drive a single Router's CancelFuncs from whichever
+// goroutine each request happens to run on. Run with -race to catch a
+// regression that drops the mutex around cf.Funcs.
+func TestCancelFuncsConcurrent(t *testing.T) {
+	cf := &CancelFuncs{Funcs: make(map[string]context.CancelFunc)}
+
+	const n = 100
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			defer wg.Done()
+			id := fmt.Sprintf("req-%d", i)
+
+			cancelled := false
+			cf.Add(id, func() { cancelled = true })
+			cf.Snapshot()
+			cf.Call(id)
+			_ = cancelled
+			cf.Remove(id)
+		}(i)
+	}
+	wg.Wait()
+
+	if got := len(cf.Snapshot()); got != 0 {
+		t.Fatalf("expected no CancelFuncs left registered, got %d", got)
+	}
+}
+
+// TestCancelFuncsCall checks the actual contract Meta.Cancel relies on:
+// Call runs the registered func exactly once and reports whether it
+// found one, then forgets it.
+func TestCancelFuncsCall(t *testing.T) {
+	cf := &CancelFuncs{Funcs: make(map[string]context.CancelFunc)}
+
+	calls := 0
+	cf.Add("a", func() { calls++ })
+
+	if !cf.Call("a") {
+		t.Fatal("Call(\"a\") = false, want true")
+	}
+	if calls != 1 {
+		t.Fatalf("cancel func called %d times, want 1", calls)
+	}
+	if cf.Call("a") {
+		t.Fatal("Call(\"a\") after removal = true, want false")
+	}
+}
+
+// TestCancelFuncsCancelAllPrefix checks CancelAll's prefix filtering:
+// only ids starting with the prefix are cancelled and removed.
+func TestCancelFuncsCancelAllPrefix(t *testing.T) {
+	cf := &CancelFuncs{Funcs: make(map[string]context.CancelFunc)}
+
+	var cancelled []string
+	for _, id := range []string{"batch1/0", "batch1/1", "batch2/0"} {
+		id := id
+		cf.Add(id, func() { cancelled = append(cancelled, id) })
+	}
+
+	if n := cf.CancelAll("batch1/"); n != 2 {
+		t.Fatalf("CancelAll(\"batch1/\") = %d, want 2", n)
+	}
+	if got := len(cf.Snapshot()); got != 1 {
+		t.Fatalf("expected 1 CancelFunc left, got %d", got)
+	}
+}
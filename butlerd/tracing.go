@@ -0,0 +1,29 @@
+package butlerd
+
+import (
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TracingMiddleware opens an OpenTelemetry span per RPC on tracer,
+// tagged with method, request id and butlerVersion, and records the
+// handler's error (if any) on the span before ending it.
+func TracingMiddleware(tracer trace.Tracer, butlerVersion string) Middleware {
+	return func(next RequestHandler) RequestHandler {
+		return func(rc *RequestContext) (interface{}, error) {
+			ctx, span := tracer.Start(rc.Ctx, rc.Method, trace.WithAttributes(
+				attribute.String("butlerd.method", rc.Method),
+				attribute.String("butlerd.request_id", rc.ID),
+				attribute.String("butlerd.version", butlerVersion),
+			))
+			defer span.End()
+
+			rc.Ctx = ctx
+			res, err := next(rc)
+			if err != nil {
+				span.RecordError(err)
+			}
+			return res, err
+		}
+	}
+}
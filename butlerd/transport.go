@@ -0,0 +1,299 @@
+package butlerd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sourcegraph/jsonrpc2"
+)
+
+// Transport is implemented by anything that can accept incoming butlerd
+// calls and hand them off to a Router. The JSON-RPC2 loop butlerd has
+// always spoken and the newer gRPC server (see grpc.go) both satisfy it,
+// so callers that only care about "run this router until ctx is done"
+// don't need to know which wire format is underneath.
+type Transport interface {
+	// Serve blocks, accepting and dispatching requests against router,
+	// until ctx is cancelled or an unrecoverable transport error occurs.
+	Serve(ctx context.Context, router *Router) error
+}
+
+// JSONRPC2Transport serves the framed JSON-RPC2 wire format butlerd has
+// always spoken, over a plain TCP listener. A single request or
+// notification is dispatched through the same Router.invoke path
+// GRPCTransport uses; a top-level JSON array is recognized by
+// batchAwareCodec (see batchcodec.go) and routed through
+// Router.DispatchBatch instead. It's what lets callers that only care
+// about "run this router until ctx is done" treat the original
+// transport and the gRPC one (see grpc.go) polymorphically.
+type JSONRPC2Transport struct {
+	Addr string
+
+	listener net.Listener
+}
+
+var _ Transport = (*JSONRPC2Transport)(nil)
+
+// Serve starts accepting connections on t.Addr and dispatches every
+// request or notification each one carries against router, until ctx is
+// cancelled or the listener fails.
+func (t *JSONRPC2Transport) Serve(ctx context.Context, router *Router) error {
+	lis, err := net.Listen("tcp", t.Addr)
+	if err != nil {
+		return errors.WithStack(err)
+	}
+	t.listener = lis
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- t.acceptLoop(ctx, router, lis)
+	}()
+
+	select {
+	case <-ctx.Done():
+		lis.Close()
+		return ctx.Err()
+	case err := <-errs:
+		return errors.WithStack(err)
+	}
+}
+
+// acceptLoop accepts connections off lis until it's closed (by Serve,
+// once ctx is cancelled) or Accept returns some other error.
+func (t *JSONRPC2Transport) acceptLoop(ctx context.Context, router *Router, lis net.Listener) error {
+	for {
+		conn, err := lis.Accept()
+		if err != nil {
+			return err
+		}
+
+		codec := &batchAwareCodec{router: router, ctx: ctx, writer: conn}
+		stream := jsonrpc2.NewBufferedStream(conn, codec)
+		codec.setConn(jsonrpc2.NewConn(ctx, stream, jsonrpc2RouterHandler{router: router}))
+	}
+}
+
+// jsonrpc2RouterHandler adapts Router.Dispatch to the jsonrpc2.Handler
+// interface the jsonrpc2 package dispatches incoming requests through.
+// origConn is the same *jsonrpc2.Conn for every request on a given
+// connection, which is what lets Authenticator implementations (see
+// auth.go) recognize repeat calls from an already-authenticated client.
+type jsonrpc2RouterHandler struct {
+	router *Router
+}
+
+func (h jsonrpc2RouterHandler) Handle(ctx context.Context, conn *jsonrpc2.Conn, req *jsonrpc2.Request) {
+	h.router.Dispatch(ctx, conn, req)
+}
+
+// invocation carries everything Router.invoke needs to run a handler or
+// notification handler, independent of which Transport the call arrived
+// on. jsonrpc2's Dispatch and the grpc Transport both build one of these
+// and hand it to invoke.
+type invocation struct {
+	// ID identifies the request to CancelFuncs, so Meta.Cancel and a
+	// deadline expiring both tear down the same context. Notifications,
+	// which have no reply to cancel, are never registered, whatever ID
+	// they carry.
+	ID     string
+	Method string
+	Notif  bool
+	Params *json.RawMessage
+	Conn   Conn
+
+	// ConnKey identifies the physical connection a request arrived on,
+	// stable across every request/batch element that connection ever
+	// sends - unlike Conn, which Dispatch/DispatchBatch/the gRPC
+	// transport are free to wrap in a fresh value per call. Authenticator
+	// implementations that need to remember "this connection already
+	// completed a handshake" (e.g. SharedSecretAuthenticator) must key off
+	// this instead of Conn.
+	ConnKey interface{}
+}
+
+// requestDeadlineEnvelope captures the two optional fields every
+// request's params implicitly extend: a client can set an absolute
+// `deadline` or a relative `timeoutMs` to have butler abort a
+// long-running call (e.g. Install) instead of leaving it to run
+// forever. Decoding into this alone, rather than the handler's own
+// params struct, means we don't need every params type to declare it.
+type requestDeadlineEnvelope struct {
+	Deadline  *time.Time `json:"deadline,omitempty"`
+	TimeoutMs *int64     `json:"timeoutMs,omitempty"`
+}
+
+// withRequestDeadline derives a deadline-bound context from params if
+// the caller set `deadline` or `timeoutMs`. ok is false (and ctx is
+// returned unchanged) if neither was set or params didn't parse.
+func withRequestDeadline(ctx context.Context, params *json.RawMessage) (dctx context.Context, cancel context.CancelFunc, ok bool) {
+	if params == nil {
+		return ctx, nil, false
+	}
+
+	var env requestDeadlineEnvelope
+	if err := json.Unmarshal(*params, &env); err != nil {
+		return ctx, nil, false
+	}
+
+	switch {
+	case env.Deadline != nil:
+		dctx, cancel = context.WithDeadline(ctx, *env.Deadline)
+		return dctx, cancel, true
+	case env.TimeoutMs != nil:
+		dctx, cancel = context.WithTimeout(ctx, time.Duration(*env.TimeoutMs)*time.Millisecond)
+		return dctx, cancel, true
+	default:
+		return ctx, nil, false
+	}
+}
+
+// invoke runs the registered handler (or notification handler) for inv
+// against a freshly-built RequestContext. It's the transport-agnostic
+// core that used to live inline in Dispatch; Dispatch and the gRPC
+// Transport both call it.
+func (r *Router) invoke(ctx context.Context, inv invocation) (res interface{}, err error) {
+	var principal Principal
+	if r.Authenticator != nil {
+		var authErr error
+		principal, authErr = r.Authenticator.Authenticate(ctx, inv)
+		if authErr != nil {
+			return nil, &RpcError{
+				Code:    int64(CodeUnauthenticated),
+				Message: authErr.Error(),
+			}
+		}
+
+		if !inv.Notif {
+			if policy, ok := r.Policies[inv.Method]; ok && !policy.allows(principal) {
+				return nil, &RpcError{
+					Code:    int64(CodePermissionDenied),
+					Message: fmt.Sprintf("%s requires one of scopes %v", inv.Method, policy.Scopes),
+				}
+			}
+		}
+	}
+
+	// Every request (not just deadline-bound ones) gets its own
+	// cancellable context registered under its ID, so Meta.Cancel and
+	// Meta.CancelBatch (see batch.go) have something to call regardless
+	// of whether the client set a deadline.
+	if !inv.Notif && inv.ID != "" {
+		var cancel context.CancelFunc
+		if dctx, dcancel, ok := withRequestDeadline(ctx, inv.Params); ok {
+			ctx, cancel = dctx, dcancel
+
+			start := time.Now()
+			deadline, _ := dctx.Deadline()
+			go func() {
+				<-dctx.Done()
+				if dctx.Err() == context.DeadlineExceeded {
+					inv.Conn.Notify(context.Background(), "Timeout", &TimeoutNotification{
+						ElapsedSeconds:   time.Since(start).Seconds(),
+						RemainingSeconds: time.Until(deadline).Seconds(),
+					})
+				}
+			}()
+		} else {
+			ctx, cancel = context.WithCancel(ctx)
+		}
+
+		defer cancel()
+		r.CancelFuncs.Add(inv.ID, cancel)
+		defer r.CancelFuncs.Remove(inv.ID)
+	}
+
+	consumer, cErr := NewStateConsumer(&NewStateConsumerParams{
+		Ctx:  ctx,
+		Conn: inv.Conn,
+	})
+	if cErr != nil {
+		return nil, cErr
+	}
+
+	rc := &RequestContext{
+		Ctx:         ctx,
+		Consumer:    consumer,
+		Params:      inv.Params,
+		Conn:        inv.Conn,
+		CancelFuncs: r.CancelFuncs,
+		DBPool:      r.dbPool,
+		Client:      r.getClient,
+		Method:      inv.Method,
+		ID:          inv.ID,
+		Principal:   principal,
+
+		ButlerVersion:       r.ButlerVersion,
+		ButlerVersionString: r.ButlerVersionString,
+	}
+
+	if inv.Notif {
+		invokeNotificationHandler(rc, r.NotificationHandlers[inv.Method])
+		return nil, nil
+	}
+
+	h, ok := r.Handlers[inv.Method]
+	if !ok {
+		return nil, &RpcError{
+			Code:    jsonrpc2.CodeMethodNotFound,
+			Message: fmt.Sprintf("Method '%s' not found", inv.Method),
+		}
+	}
+
+	rc.Consumer.OnProgress = func(alpha float64) {
+		if rc.tracker == nil {
+			// skip
+			return
+		}
+
+		rc.tracker.SetProgress(alpha)
+		notif := &ProgressNotification{
+			Progress: alpha,
+			ETA:      rc.tracker.ETA().Seconds(),
+			BPS:      rc.tracker.BPS(),
+		}
+		// cannot use autogenerated wrappers to avoid import cycles
+		rc.Notify("Progress", notif)
+	}
+	rc.Consumer.OnProgressLabel = func(label string) {
+		// muffin
+	}
+	rc.Consumer.OnPauseProgress = func() {
+		if rc.tracker != nil {
+			rc.tracker.Pause()
+		}
+	}
+	rc.Consumer.OnResumeProgress = func() {
+		if rc.tracker != nil {
+			rc.tracker.Resume()
+		}
+	}
+
+	// No recover here: a handler panic is turned into an error by
+	// PanicRecoveryMiddleware (see middleware.go), which NewRouter
+	// registers outermost by default so third parties composing their
+	// own middleware chain can still see, reposition, or drop it,
+	// instead of being wrapped by an invisible net they can't reach.
+	return r.chain(h)(rc)
+}
+
+// invokeNotificationHandler runs nh, recovering a panic into a debug log
+// line instead of letting it take down the whole daemon. Notifications
+// have no reply to carry an error back through, so unlike RequestHandler
+// they don't go through Router's composable middleware chain (see
+// middleware.go) - there's nowhere else for this recover to live.
+func invokeNotificationHandler(rc *RequestContext, nh NotificationHandler) {
+	if nh == nil {
+		return
+	}
+
+	defer func() {
+		if rec := recover(); rec != nil {
+			rc.Consumer.Errorf("panic in %s notification handler: %v", rc.Method, rec)
+		}
+	}()
+	nh(rc)
+}
@@ -0,0 +1,94 @@
+package butlerd
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func rawParams(t *testing.T, v interface{}) *json.RawMessage {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("marshal params: %v", err)
+	}
+	raw := json.RawMessage(data)
+	return &raw
+}
+
+// TestWithRequestDeadlineTimeoutMs checks that a `timeoutMs` param
+// derives a context that's actually bound to roughly that duration.
+func TestWithRequestDeadlineTimeoutMs(t *testing.T) {
+	params := rawParams(t, map[string]interface{}{"timeoutMs": 50})
+
+	ctx, cancel, ok := withRequestDeadline(context.Background(), params)
+	if !ok {
+		t.Fatal("withRequestDeadline() ok = false, want true")
+	}
+	defer cancel()
+
+	select {
+	case <-ctx.Done():
+		t.Fatal("context done immediately, want it to survive briefly")
+	default:
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		t.Fatal("expected ctx to carry a deadline")
+	}
+	if remaining := time.Until(deadline); remaining <= 0 || remaining > time.Second {
+		t.Fatalf("deadline %v from now, want something close to 50ms", remaining)
+	}
+}
+
+// TestWithRequestDeadlineExplicit checks the `deadline` (absolute time)
+// path, distinct from `timeoutMs` (relative duration).
+func TestWithRequestDeadlineExplicit(t *testing.T) {
+	want := time.Now().Add(time.Minute)
+	params := rawParams(t, map[string]interface{}{"deadline": want})
+
+	ctx, cancel, ok := withRequestDeadline(context.Background(), params)
+	if !ok {
+		t.Fatal("withRequestDeadline() ok = false, want true")
+	}
+	defer cancel()
+
+	got, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		t.Fatal("expected ctx to carry a deadline")
+	}
+	if diff := got.Sub(want); diff > time.Second || diff < -time.Second {
+		t.Fatalf("deadline = %v, want ~%v", got, want)
+	}
+}
+
+// TestWithRequestDeadlineNone checks the common case - no deadline or
+// timeoutMs set - passes ctx through unchanged instead of manufacturing
+// one.
+func TestWithRequestDeadlineNone(t *testing.T) {
+	params := rawParams(t, map[string]interface{}{"foo": "bar"})
+
+	ctx := context.Background()
+	got, cancel, ok := withRequestDeadline(ctx, params)
+	if ok {
+		t.Fatal("withRequestDeadline() ok = true, want false")
+	}
+	if cancel != nil {
+		t.Fatal("expected nil cancel func when ok is false")
+	}
+	if got != ctx {
+		t.Fatal("expected the original ctx to be returned unchanged")
+	}
+}
+
+// TestWithRequestDeadlineNilParams checks the nil-params case Dispatch
+// hits for a method whose call took no arguments at all.
+func TestWithRequestDeadlineNilParams(t *testing.T) {
+	ctx := context.Background()
+	got, cancel, ok := withRequestDeadline(ctx, nil)
+	if ok || cancel != nil || got != ctx {
+		t.Fatalf("withRequestDeadline(ctx, nil) = %v, %v, %v; want ctx, nil, false", got, cancel, ok)
+	}
+}